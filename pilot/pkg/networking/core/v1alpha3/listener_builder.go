@@ -0,0 +1,180 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha3
+
+import (
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/types"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+const (
+	// VirtualOutboundListenerName is the name for the virtual outbound listener used for iptables redirection
+	VirtualOutboundListenerName = "virtualOutbound"
+
+	// VirtualInboundListenerName is the name for the virtual inbound listener used for iptables redirection
+	VirtualInboundListenerName = "virtualInbound"
+
+	// PilotMetaKey is the key under which Pilot stashes its own per-filter-chain bookkeeping
+	// in the Envoy listener filter chain metadata.
+	PilotMetaKey = "istio"
+)
+
+// ListenerBuilder is a stateful builder that progressively assembles the set of listeners
+// pushed to a single proxy. Each stage appends or augments listeners; getListeners returns
+// the final ordered result.
+type ListenerBuilder struct {
+	node *model.Proxy
+
+	inboundListeners        []*xdsapi.Listener
+	outboundListeners       []*xdsapi.Listener
+	managementListeners     []*xdsapi.Listener
+	virtualOutboundListener *xdsapi.Listener
+	virtualInboundListener  *xdsapi.Listener
+}
+
+// NewListenerBuilder creates a ListenerBuilder for the given proxy.
+func NewListenerBuilder(node *model.Proxy) *ListenerBuilder {
+	return &ListenerBuilder{
+		node: node,
+	}
+}
+
+// buildSidecarInboundListeners builds the per-port inbound listeners for the proxy's own
+// service instances, then applies any configured tracing.
+func (builder *ListenerBuilder) buildSidecarInboundListeners(
+	configgen *ConfigGeneratorImpl,
+	env *model.Environment,
+	node *model.Proxy,
+	push *model.PushContext) *ListenerBuilder {
+	builder.inboundListeners = configgen.buildSidecarInboundListeners(env, node, push)
+	builder.applyTracingConfig(builder.inboundListeners, node, push)
+	return builder
+}
+
+// buildSidecarOutboundListeners builds the outbound listeners for services the proxy can
+// reach, then applies any configured tracing.
+func (builder *ListenerBuilder) buildSidecarOutboundListeners(
+	configgen *ConfigGeneratorImpl,
+	env *model.Environment,
+	node *model.Proxy,
+	push *model.PushContext) *ListenerBuilder {
+	builder.outboundListeners = configgen.buildSidecarOutboundListeners(env, node, push)
+	builder.applyTracingConfig(builder.outboundListeners, node, push)
+	return builder
+}
+
+// buildVirtualOutboundListener builds the single virtual listener iptables redirects
+// outbound traffic to, then applies any configured tracing.
+func (builder *ListenerBuilder) buildVirtualOutboundListener(
+	configgen *ConfigGeneratorImpl,
+	env *model.Environment,
+	node *model.Proxy,
+	push *model.PushContext) *ListenerBuilder {
+	if node.GetInterceptionMode() == model.InterceptionNone {
+		return builder
+	}
+	vo := configgen.buildVirtualOutboundListener(env, node, push)
+	builder.applyTracingConfig([]*xdsapi.Listener{vo}, node, push)
+	builder.virtualOutboundListener = vo
+	return builder
+}
+
+// buildVirtualInboundListener merges the per-port inbound listeners into a single listener
+// that iptables redirects all inbound traffic to, tagging each nested filter chain with the
+// name of the listener it originated from so later stages (e.g. stats, RBAC) can recover it.
+// The merged filter chains are the same *FilterChain values as builder.inboundListeners, so
+// they already carry whatever tracing config buildSidecarInboundListeners applied earlier;
+// the passthrough chains appended here are plain TCP and have no HCM filter to trace.
+func (builder *ListenerBuilder) buildVirtualInboundListener(
+	env *model.Environment,
+	node *model.Proxy) *ListenerBuilder {
+	if !isInboundCaptureAll(node) {
+		return builder
+	}
+
+	var allChains []*xdsapi.FilterChain
+	for _, l := range builder.inboundListeners {
+		for _, fc := range l.FilterChains {
+			taggedFilterChainMetadata(fc, l.Name)
+			allChains = append(allChains, fc)
+		}
+	}
+	allChains = append(allChains, buildPassthroughFilterChain(VirtualInboundListenerName, false)...)
+	allChains = append(allChains, buildPassthroughFilterChain(VirtualInboundListenerName, true)...)
+
+	builder.virtualInboundListener = &xdsapi.Listener{
+		Name:         VirtualInboundListenerName,
+		FilterChains: allChains,
+	}
+	return builder
+}
+
+// getListeners returns the listeners assembled so far, in the order Pilot always pushes
+// them: per-port inbound, per-port outbound, the virtual outbound listener, and finally the
+// virtual inbound listener.
+func (builder *ListenerBuilder) getListeners() []*xdsapi.Listener {
+	nListener := len(builder.inboundListeners) + len(builder.outboundListeners)
+	if builder.virtualOutboundListener != nil {
+		nListener++
+	}
+	if builder.virtualInboundListener != nil {
+		nListener++
+	}
+
+	listeners := make([]*xdsapi.Listener, 0, nListener)
+	listeners = append(listeners, builder.inboundListeners...)
+	listeners = append(listeners, builder.outboundListeners...)
+	if builder.virtualOutboundListener != nil {
+		listeners = append(listeners, builder.virtualOutboundListener)
+	}
+	if builder.virtualInboundListener != nil {
+		listeners = append(listeners, builder.virtualInboundListener)
+	}
+	return listeners
+}
+
+func isInboundCaptureAll(node *model.Proxy) bool {
+	return node.Metadata[model.NodeMetadataInterceptionMode] == "REDIRECT" &&
+		node.Metadata[model.IstioIncludeInboundPorts] == model.AllPortsLiteral
+}
+
+// buildPassthroughFilterChain returns the fallback TCP passthrough filter chain used by the
+// virtual inbound listener when no other filter chain on it matches, one per IP family.
+func buildPassthroughFilterChain(listenerName string, ipv6 bool) []*xdsapi.FilterChain {
+	fc := &xdsapi.FilterChain{
+		Metadata: &types.Struct{Fields: map[string]*types.Value{}},
+	}
+	taggedFilterChainMetadata(fc, listenerName)
+	return []*xdsapi.FilterChain{fc}
+}
+
+func taggedFilterChainMetadata(fc *xdsapi.FilterChain, originalListenerName string) {
+	if fc.Metadata == nil {
+		fc.Metadata = &types.Struct{}
+	}
+	if fc.Metadata.FilterMetadata == nil {
+		fc.Metadata.FilterMetadata = map[string]*types.Struct{}
+	}
+	meta, ok := fc.Metadata.FilterMetadata[PilotMetaKey]
+	if !ok {
+		meta = &types.Struct{Fields: map[string]*types.Value{}}
+		fc.Metadata.FilterMetadata[PilotMetaKey] = meta
+	}
+	meta.Fields["original_listener_name"] = &types.Value{
+		Kind: &types.Value_StringValue{StringValue: originalListenerName},
+	}
+}
@@ -18,6 +18,12 @@ import (
 	"strings"
 	"testing"
 
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	xdslistener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/gogo/protobuf/types"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/plugin"
 	"istio.io/istio/pkg/config/protocol"
@@ -218,3 +224,206 @@ func TestVirtualInboundListenerBuilder(t *testing.T) {
 		}
 	}
 }
+
+func findHTTPConnectionManager(l *xdsapi.Listener) *xdslistener.Filter {
+	for _, fc := range l.FilterChains {
+		for _, filter := range fc.Filters {
+			if filter.Name == httpConnectionManagerFilterName {
+				return filter
+			}
+		}
+	}
+	return nil
+}
+
+func TestListenerBuilderTracing(t *testing.T) {
+	ldsEnv := getDefaultLdsEnv()
+	service := buildService("test.com", wildcardIP, protocol.HTTP, tnow)
+	services := []*model.Service{service}
+
+	env := buildListenerEnv(services)
+	env.Mesh.DefaultConfig = &meshconfig.ProxyConfig{
+		Tracing: &meshconfig.Tracing{
+			Provider: &meshconfig.Tracing_Zipkin_{
+				Zipkin: &meshconfig.Tracing_Zipkin{Address: "zipkin.istio-system:9411"},
+			},
+		},
+	}
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatalf("init push context error: %s", err.Error())
+	}
+	instances := make([]*model.ServiceInstance, len(services))
+	for i, s := range services {
+		instances[i] = &model.ServiceInstance{
+			Service:  s,
+			Endpoint: buildEndpoint(s),
+		}
+	}
+	proxy := getDefaultProxy()
+	proxy.ServiceInstances = instances
+	setNilSidecarOnProxy(&proxy, env.PushContext)
+
+	builder := NewListenerBuilder(&proxy)
+	listeners := builder.buildSidecarInboundListeners(ldsEnv.configgen, &env, &proxy, env.PushContext).
+		getListeners()
+
+	filter := findHTTPConnectionManager(listeners[0])
+	if filter == nil {
+		t.Fatalf("expected an HTTP connection manager filter on the HTTP listener")
+	}
+	hcmConfig := &hcm.HttpConnectionManager{}
+	if err := types.UnmarshalAny(filter.GetTypedConfig(), hcmConfig); err != nil {
+		t.Fatalf("failed to unmarshal HTTP connection manager: %v", err)
+	}
+	if hcmConfig.Tracing == nil {
+		t.Fatal("expected tracing config to be injected into the HTTP listener")
+	}
+	if hcmConfig.Tracing.Provider.Name != "envoy.zipkin" {
+		t.Fatalf("expected zipkin tracing provider, got %s", hcmConfig.Tracing.Provider.Name)
+	}
+}
+
+func TestListenerBuilderTracingAppliesToOutboundListeners(t *testing.T) {
+	ldsEnv := getDefaultLdsEnv()
+	service := buildService("test.com", wildcardIP, protocol.HTTP, tnow)
+	services := []*model.Service{service}
+
+	env := buildListenerEnv(services)
+	env.Mesh.DefaultConfig = &meshconfig.ProxyConfig{
+		Tracing: &meshconfig.Tracing{
+			Provider: &meshconfig.Tracing_Zipkin_{
+				Zipkin: &meshconfig.Tracing_Zipkin{Address: "zipkin.istio-system:9411"},
+			},
+		},
+	}
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatalf("init push context error: %s", err.Error())
+	}
+	proxy := getDefaultProxy()
+	setNilSidecarOnProxy(&proxy, env.PushContext)
+
+	builder := NewListenerBuilder(&proxy)
+	listeners := builder.buildSidecarOutboundListeners(ldsEnv.configgen, &env, &proxy, env.PushContext).
+		getListeners()
+
+	var foundHTTP bool
+	for _, l := range listeners {
+		if filter := findHTTPConnectionManager(l); filter != nil {
+			foundHTTP = true
+			hcmConfig := &hcm.HttpConnectionManager{}
+			if err := types.UnmarshalAny(filter.GetTypedConfig(), hcmConfig); err != nil {
+				t.Fatalf("failed to unmarshal HTTP connection manager: %v", err)
+			}
+			if hcmConfig.Tracing == nil {
+				t.Fatalf("expected tracing config to be injected into outbound listener %s", l.Name)
+			}
+		}
+	}
+	if !foundHTTP {
+		t.Fatal("expected at least one outbound HTTP listener with an HTTP connection manager filter")
+	}
+}
+
+func TestListenerBuilderTracingAppliesToVirtualListeners(t *testing.T) {
+	ldsEnv := getDefaultLdsEnv()
+	service := buildService("test.com", wildcardIP, protocol.HTTP, tnow)
+	services := []*model.Service{service}
+
+	env := buildListenerEnv(services)
+	env.Mesh.DefaultConfig = &meshconfig.ProxyConfig{
+		Tracing: &meshconfig.Tracing{
+			Provider: &meshconfig.Tracing_Zipkin_{
+				Zipkin: &meshconfig.Tracing_Zipkin{Address: "zipkin.istio-system:9411"},
+			},
+		},
+	}
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatalf("init push context error: %s", err.Error())
+	}
+	instances := make([]*model.ServiceInstance, len(services))
+	for i, s := range services {
+		instances[i] = &model.ServiceInstance{
+			Service:  s,
+			Endpoint: buildEndpoint(s),
+		}
+	}
+	proxy := getDefaultProxy()
+	proxy.ServiceInstances = instances
+	setInboundCaptureAllOnThisNode(&proxy)
+	setNilSidecarOnProxy(&proxy, env.PushContext)
+
+	builder := NewListenerBuilder(&proxy)
+	listeners := builder.buildSidecarInboundListeners(ldsEnv.configgen, &env, &proxy, env.PushContext).
+		buildVirtualOutboundListener(ldsEnv.configgen, &env, &proxy, env.PushContext).
+		buildVirtualInboundListener(&env, &proxy).
+		getListeners()
+
+	if len(listeners) != 3 {
+		t.Fatalf("expected %d listeners, found %d", 3, len(listeners))
+	}
+
+	virtualOutbound := listeners[1]
+	filter := findHTTPConnectionManager(virtualOutbound)
+	if filter == nil {
+		t.Fatal("expected an HTTP connection manager filter on the virtual outbound listener")
+	}
+	hcmConfig := &hcm.HttpConnectionManager{}
+	if err := types.UnmarshalAny(filter.GetTypedConfig(), hcmConfig); err != nil {
+		t.Fatalf("failed to unmarshal HTTP connection manager: %v", err)
+	}
+	if hcmConfig.Tracing == nil {
+		t.Fatal("expected tracing config to be injected into the virtual outbound listener")
+	}
+
+	virtualInbound := listeners[2]
+	filter = findHTTPConnectionManager(virtualInbound)
+	if filter == nil {
+		t.Fatal("expected an HTTP connection manager filter on the virtual inbound listener")
+	}
+	hcmConfig = &hcm.HttpConnectionManager{}
+	if err := types.UnmarshalAny(filter.GetTypedConfig(), hcmConfig); err != nil {
+		t.Fatalf("failed to unmarshal HTTP connection manager: %v", err)
+	}
+	if hcmConfig.Tracing == nil {
+		t.Fatal("expected tracing config to be injected into the virtual inbound listener")
+	}
+}
+
+func TestListenerBuilderTracingSkipsTCPListeners(t *testing.T) {
+	ldsEnv := getDefaultLdsEnv()
+	service := buildService("tcp.com", wildcardIP, protocol.TCP, tnow)
+	services := []*model.Service{service}
+
+	env := buildListenerEnv(services)
+	env.Mesh.DefaultConfig = &meshconfig.ProxyConfig{
+		Tracing: &meshconfig.Tracing{
+			Provider: &meshconfig.Tracing_Zipkin_{
+				Zipkin: &meshconfig.Tracing_Zipkin{Address: "zipkin.istio-system:9411"},
+			},
+		},
+	}
+	if err := env.PushContext.InitContext(&env); err != nil {
+		t.Fatalf("init push context error: %s", err.Error())
+	}
+	instances := make([]*model.ServiceInstance, len(services))
+	for i, s := range services {
+		instances[i] = &model.ServiceInstance{
+			Service:  s,
+			Endpoint: buildEndpoint(s),
+		}
+	}
+	proxy := getDefaultProxy()
+	proxy.ServiceInstances = instances
+	setNilSidecarOnProxy(&proxy, env.PushContext)
+
+	builder := NewListenerBuilder(&proxy)
+	listeners := builder.buildSidecarInboundListeners(ldsEnv.configgen, &env, &proxy, env.PushContext).
+		getListeners()
+
+	if len(listeners) != 1 {
+		t.Fatalf("expected %d listeners, found %d", 1, len(listeners))
+	}
+	if findHTTPConnectionManager(listeners[0]) != nil {
+		t.Fatal("did not expect an HTTP connection manager filter on a TCP-only listener")
+	}
+}
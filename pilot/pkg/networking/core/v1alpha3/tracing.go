@@ -0,0 +1,166 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha3
+
+import (
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	xdslistener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	envoytrace "github.com/envoyproxy/go-control-plane/envoy/config/trace/v2"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	tracingtype "github.com/envoyproxy/go-control-plane/envoy/type/tracing/v2"
+	"github.com/gogo/protobuf/types"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+	"istio.io/pkg/log"
+)
+
+const httpConnectionManagerFilterName = "envoy.http_connection_manager"
+
+// applyTracingConfig stamps the mesh-wide tracing configuration onto the HttpConnectionManager
+// of every HTTP filter chain in listeners. Listeners without an HCM filter -- i.e. plain TCP
+// listeners -- are left untouched.
+func (builder *ListenerBuilder) applyTracingConfig(listeners []*xdsapi.Listener, node *model.Proxy, push *model.PushContext) {
+	tracing := tracingConfigForProxy(push)
+	if tracing == nil {
+		return
+	}
+
+	envoyTracing := buildEnvoyTracing(tracing)
+	if envoyTracing == nil {
+		return
+	}
+
+	for _, l := range listeners {
+		for _, fc := range l.FilterChains {
+			for _, filter := range fc.Filters {
+				if filter.Name != httpConnectionManagerFilterName {
+					continue
+				}
+				hcmConfig := &hcm.HttpConnectionManager{}
+				if err := types.UnmarshalAny(filter.GetTypedConfig(), hcmConfig); err != nil {
+					log.Warnf("failed to unmarshal HTTP connection manager for tracing injection: %v", err)
+					continue
+				}
+				hcmConfig.Tracing = envoyTracing
+				filter.ConfigType = &xdslistener.Filter_TypedConfig{TypedConfig: util.MessageToAny(hcmConfig)}
+			}
+		}
+	}
+}
+
+// tracingConfigForProxy resolves the mesh-wide tracing configuration. There is no per-Sidecar
+// override today - model.SidecarScope carries no tracing field - so every proxy in the mesh
+// gets the same tracing config.
+func tracingConfigForProxy(push *model.PushContext) *meshconfig.Tracing {
+	if push.Mesh == nil || push.Mesh.DefaultConfig == nil {
+		return nil
+	}
+	return push.Mesh.DefaultConfig.Tracing
+}
+
+// buildEnvoyTracing translates the typed mesh Tracing config into the envoy HCM tracing
+// stanza, including the provider-specific collector config, sampling, and custom tags.
+func buildEnvoyTracing(tracing *meshconfig.Tracing) *hcm.HttpConnectionManager_Tracing {
+	if tracing == nil || tracing.Provider == nil {
+		return nil
+	}
+
+	out := &hcm.HttpConnectionManager_Tracing{
+		ClientSampling:  toPercent(tracing.ClientSampling),
+		RandomSampling:  toPercent(tracing.RandomSampling),
+		OverallSampling: toPercent(tracing.OverallSampling),
+	}
+
+	switch provider := tracing.Provider.(type) {
+	case *meshconfig.Tracing_Zipkin_:
+		out.Provider = &envoytrace.Tracing_Http{
+			Name: "envoy.zipkin",
+			ConfigType: &envoytrace.Tracing_Http_TypedConfig{
+				TypedConfig: util.MessageToAny(&envoytrace.ZipkinConfig{
+					CollectorCluster:         provider.Zipkin.ServiceName,
+					CollectorEndpoint:        provider.Zipkin.Address,
+					CollectorEndpointVersion: envoytrace.ZipkinConfig_HTTP_JSON,
+				}),
+			},
+		}
+	case *meshconfig.Tracing_Datadog_:
+		out.Provider = &envoytrace.Tracing_Http{
+			Name: "envoy.datadog",
+			ConfigType: &envoytrace.Tracing_Http_TypedConfig{
+				TypedConfig: util.MessageToAny(&envoytrace.DatadogConfig{
+					CollectorCluster: provider.Datadog.Address,
+					ServiceName:      provider.Datadog.ServiceName,
+				}),
+			},
+		}
+	case *meshconfig.Tracing_Lightstep_:
+		out.Provider = &envoytrace.Tracing_Http{
+			Name: "envoy.lightstep",
+			ConfigType: &envoytrace.Tracing_Http_TypedConfig{
+				TypedConfig: util.MessageToAny(&envoytrace.LightstepConfig{
+					CollectorCluster: provider.Lightstep.Address,
+					AccessTokenFile:  provider.Lightstep.AccessToken,
+				}),
+			},
+		}
+	case *meshconfig.Tracing_OpenCensusAgent_:
+		out.Provider = &envoytrace.Tracing_Http{
+			Name: "envoy.opencensus",
+			ConfigType: &envoytrace.Tracing_Http_TypedConfig{
+				TypedConfig: util.MessageToAny(&envoytrace.OpenCensusConfig{
+					OcagentAddress:         provider.OpenCensusAgent.Address,
+					OcagentExporterEnabled: true,
+				}),
+			},
+		}
+	default:
+		return nil
+	}
+
+	for _, tag := range tracing.CustomTags {
+		out.CustomTags = append(out.CustomTags, buildCustomTag(tag))
+	}
+
+	return out
+}
+
+func buildCustomTag(tag *meshconfig.Tracing_CustomTag) *tracingtype.CustomTag {
+	ct := &tracingtype.CustomTag{Tag: tag.Tag}
+	switch t := tag.Type.(type) {
+	case *meshconfig.Tracing_CustomTag_Literal:
+		ct.Type = &tracingtype.CustomTag_Literal_{Literal: &tracingtype.CustomTag_Literal{Value: t.Literal.Value}}
+	case *meshconfig.Tracing_CustomTag_Header:
+		ct.Type = &tracingtype.CustomTag_RequestHeader{RequestHeader: &tracingtype.CustomTag_Header{
+			Name:         t.Header.Name,
+			DefaultValue: t.Header.DefaultValue,
+		}}
+	case *meshconfig.Tracing_CustomTag_Environment:
+		ct.Type = &tracingtype.CustomTag_Environment_{Environment: &tracingtype.CustomTag_Environment{
+			Name:         t.Environment.Name,
+			DefaultValue: t.Environment.DefaultValue,
+		}}
+	}
+	return ct
+}
+
+func toPercent(v *types.DoubleValue) *envoytype.Percent {
+	if v == nil {
+		return nil
+	}
+	return &envoytype.Percent{Value: v.Value}
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"strings"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// watchedConfigKindsMetadataKey is the proxy metadata key a proxy's watched config resource
+// kinds (e.g. "VirtualService,DestinationRule") are published under. There is no dedicated
+// model.Proxy/SidecarScope field for this yet, and Metadata is already the place ad hoc
+// per-proxy attributes live (see model.NodeMetadataConfigNamespace and friends), so it is
+// sourced from there rather than inventing new model schema this series doesn't own.
+const watchedConfigKindsMetadataKey = "CONFIG_KINDS"
+
+// PushRequest scopes a push to the subset of proxies it can actually affect. It is the typed
+// replacement for deciding relevance by hand: the push generator fills in whichever fields it
+// knows about and leaves the rest empty, and Enqueue uses it to silently skip proxies that
+// can't possibly care, rather than waking them up for a no-op push.
+//
+// An empty field means "unrestricted" for that dimension. Full always wins: a full push is
+// relevant to every proxy regardless of what else is set. When more than one dimension is
+// populated, a proxy is relevant if it matches ANY of them - the dimensions are unioned, not
+// intersected, since each one independently identifies a reason the proxy might care.
+type PushRequest struct {
+	// Full marks this as a full push, relevant to every proxy.
+	Full bool
+
+	// Namespaces restricts the push to proxies configured in one of these namespaces.
+	Namespaces map[string]struct{}
+
+	// Services restricts the push to proxies whose SidecarScope imports one of these
+	// hostnames.
+	Services map[string]struct{}
+
+	// ConfigKinds restricts the push to proxies that could be affected by a change to one of
+	// these config resource kinds (e.g. "VirtualService", "DestinationRule").
+	ConfigKinds map[string]struct{}
+}
+
+// Merge combines two PushRequests the same way PushEvent.edsUpdatedServices is merged today:
+// union the restricted sets, unless either side is unrestricted (nil) or Full, in which case
+// the wider scope wins. Merge is nil-safe on both the receiver and the argument.
+func (first *PushRequest) Merge(other *PushRequest) *PushRequest {
+	if first == nil || other == nil {
+		// A nil request is unscoped, so it absorbs whatever restriction the other side has.
+		return nil
+	}
+
+	merged := &PushRequest{
+		Full: first.Full || other.Full,
+	}
+	if merged.Full {
+		return merged
+	}
+
+	merged.Namespaces = mergeStringSets(first.Namespaces, other.Namespaces)
+	merged.Services = mergeStringSets(first.Services, other.Services)
+	merged.ConfigKinds = mergeStringSets(first.ConfigKinds, other.ConfigKinds)
+	return merged
+}
+
+// mergeStringSets unions two restriction sets. A nil set on either side means "unrestricted",
+// and unrestricted absorbs any restriction - matching the union semantics a reader would
+// expect from "no filter" rather than "filter on nothing".
+func mergeStringSets(first, other map[string]struct{}) map[string]struct{} {
+	if first == nil || other == nil {
+		return nil
+	}
+	merged := make(map[string]struct{}, len(first)+len(other))
+	for k := range first {
+		merged[k] = struct{}{}
+	}
+	for k := range other {
+		merged[k] = struct{}{}
+	}
+	return merged
+}
+
+// relevantTo reports whether the request could affect proxy. A nil request, or one with every
+// restriction left unrestricted, is relevant to everything. If at least one dimension is
+// populated, proxy is kept as soon as it intersects any one of them - a request scoping both
+// Namespaces and Services, say, must not drop a proxy that matches only one of the two.
+func (r *PushRequest) relevantTo(proxy *XdsConnection) bool {
+	if r == nil || r.Full {
+		return true
+	}
+	node := proxy.modelNode
+	if node == nil {
+		// We don't have enough information about the proxy yet (e.g. it hasn't completed
+		// its first handshake) - fail open rather than risk dropping a push it needs.
+		return true
+	}
+
+	if r.Namespaces == nil && r.Services == nil && r.ConfigKinds == nil {
+		return true
+	}
+
+	if r.Namespaces != nil {
+		if _, ok := r.Namespaces[node.ConfigNamespace]; ok {
+			return true
+		}
+	}
+
+	if r.Services != nil && node.SidecarScope != nil {
+		for _, svc := range node.SidecarScope.Services {
+			if _, ok := r.Services[string(svc.Hostname)]; ok {
+				return true
+			}
+		}
+	}
+
+	if r.ConfigKinds != nil {
+		for kind := range r.ConfigKinds {
+			if _, ok := watchedConfigKinds(node)[kind]; ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// watchedConfigKinds returns the config resource kinds node's proxy has announced it watches,
+// parsed out of its CONFIG_KINDS metadata (a comma-separated list, e.g.
+// "VirtualService,DestinationRule"). Returns nil if node has no such metadata.
+func watchedConfigKinds(node *model.Proxy) map[string]struct{} {
+	raw, ok := node.Metadata[watchedConfigKindsMetadataKey]
+	if !ok || raw == "" {
+		return nil
+	}
+	kinds := make(map[string]struct{})
+	for _, kind := range strings.Split(raw, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			kinds[kind] = struct{}{}
+		}
+	}
+	return kinds
+}
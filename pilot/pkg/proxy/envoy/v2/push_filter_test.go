@@ -0,0 +1,201 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+func proxyInNamespace(id, ns string) *XdsConnection {
+	return &XdsConnection{
+		ConID:     id,
+		modelNode: &model.Proxy{ConfigNamespace: ns},
+	}
+}
+
+func proxyWithConfigKinds(id string, kinds ...string) *XdsConnection {
+	return &XdsConnection{
+		ConID: id,
+		modelNode: &model.Proxy{
+			Metadata: map[string]string{watchedConfigKindsMetadataKey: strings.Join(kinds, ",")},
+		},
+	}
+}
+
+func proxyWithServiceInNamespace(id, ns, hostname string) *XdsConnection {
+	return &XdsConnection{
+		ConID: id,
+		modelNode: &model.Proxy{
+			ConfigNamespace: ns,
+			SidecarScope: &model.SidecarScope{
+				Services: []*model.Service{{Hostname: host.Name(hostname)}},
+			},
+		},
+	}
+}
+
+func TestPushRequestFiltersIrrelevantProxies(t *testing.T) {
+	p := NewPushQueue()
+
+	relevant := make([]*XdsConnection, 0, 5)
+	for i := 0; i < 5; i++ {
+		relevant = append(relevant, proxyInNamespace(fmt.Sprintf("relevant-%d", i), "prod"))
+	}
+	irrelevant := make([]*XdsConnection, 0, 10)
+	for i := 0; i < 10; i++ {
+		irrelevant = append(irrelevant, proxyInNamespace(fmt.Sprintf("irrelevant-%d", i), "staging"))
+	}
+
+	scoped := &PushEvent{
+		request: &PushRequest{
+			Namespaces: map[string]struct{}{"prod": {}},
+		},
+	}
+
+	for _, con := range relevant {
+		p.Enqueue(con, scoped)
+	}
+	for _, con := range irrelevant {
+		p.Enqueue(con, scoped)
+	}
+
+	if got := p.Pending(); got != len(relevant) {
+		t.Fatalf("expected %d proxies queued, got %d", len(relevant), got)
+	}
+
+	seen := map[*XdsConnection]bool{}
+	for range relevant {
+		con, _ := p.Dequeue()
+		seen[con] = true
+	}
+	for _, con := range relevant {
+		if !seen[con] {
+			t.Fatalf("expected %s to be dequeued exactly once", con.ConID)
+		}
+	}
+	for _, con := range irrelevant {
+		if seen[con] {
+			t.Fatalf("did not expect %s to ever be enqueued", con.ConID)
+		}
+	}
+	ExpectTimeout(t, p)
+}
+
+func TestPushRequestFullAlwaysRelevant(t *testing.T) {
+	p := NewPushQueue()
+	con := proxyInNamespace("any", "other-namespace")
+
+	full := &PushEvent{
+		full: true,
+		request: &PushRequest{
+			Full:       true,
+			Namespaces: map[string]struct{}{"prod": {}},
+		},
+	}
+	p.Enqueue(con, full)
+	ExpectDequeue(t, p, con)
+}
+
+func TestPushRequestMerge(t *testing.T) {
+	left := &PushRequest{Namespaces: map[string]struct{}{"ns1": {}}}
+	right := &PushRequest{Namespaces: map[string]struct{}{"ns2": {}}}
+
+	merged := left.Merge(right)
+	if merged.Full {
+		t.Fatal("merge of two non-full requests should not be full")
+	}
+	want := map[string]struct{}{"ns1": {}, "ns2": {}}
+	if len(merged.Namespaces) != len(want) {
+		t.Fatalf("expected merged namespaces %v, got %v", want, merged.Namespaces)
+	}
+	for ns := range want {
+		if _, ok := merged.Namespaces[ns]; !ok {
+			t.Fatalf("expected merged namespaces to contain %s", ns)
+		}
+	}
+
+	fullMerge := (&PushRequest{Full: true}).Merge(right)
+	if !fullMerge.Full {
+		t.Fatal("merging with a full request should produce a full request")
+	}
+}
+
+func TestPushRequestFiltersByConfigKind(t *testing.T) {
+	p := NewPushQueue()
+
+	vsWatcher := proxyWithConfigKinds("vs-watcher", "VirtualService")
+	drWatcher := proxyWithConfigKinds("dr-watcher", "DestinationRule")
+
+	scoped := &PushEvent{
+		request: &PushRequest{
+			ConfigKinds: map[string]struct{}{"VirtualService": {}},
+		},
+	}
+
+	p.Enqueue(vsWatcher, scoped)
+	p.Enqueue(drWatcher, scoped)
+
+	if got := p.Pending(); got != 1 {
+		t.Fatalf("expected 1 proxy queued, got %d", got)
+	}
+	ExpectDequeue(t, p, vsWatcher)
+	ExpectTimeout(t, p)
+}
+
+// TestPushRequestUnionsAcrossDimensions verifies a request scoping more than one dimension
+// keeps a proxy that matches ANY of them, rather than requiring it to match all of them.
+func TestPushRequestUnionsAcrossDimensions(t *testing.T) {
+	p := NewPushQueue()
+
+	// matchesNamespace matches only by namespace; matchesService is in a different namespace
+	// but imports the scoped service; unrelated matches neither. All three must be evaluated
+	// against both dimensions, not just the first one that happens not to match.
+	matchesNamespace := proxyInNamespace("ns-a-proxy", "ns-a")
+	matchesService := proxyWithServiceInNamespace("ns-b-proxy", "ns-b", "reviews.default.svc.cluster.local")
+	unrelated := proxyInNamespace("unrelated", "ns-c")
+
+	scoped := &PushEvent{
+		request: &PushRequest{
+			Namespaces: map[string]struct{}{"ns-a": {}},
+			Services:   map[string]struct{}{"reviews.default.svc.cluster.local": {}},
+		},
+	}
+
+	p.Enqueue(matchesNamespace, scoped)
+	p.Enqueue(matchesService, scoped)
+	p.Enqueue(unrelated, scoped)
+
+	if got := p.Pending(); got != 2 {
+		t.Fatalf("expected 2 proxies queued, got %d", got)
+	}
+
+	seen := map[*XdsConnection]bool{}
+	for i := 0; i < 2; i++ {
+		con, _ := p.Dequeue()
+		seen[con] = true
+	}
+	if !seen[matchesNamespace] {
+		t.Fatal("expected the namespace-matching proxy to be queued")
+	}
+	if !seen[matchesService] {
+		t.Fatal("expected the service-matching proxy to be queued despite not matching the namespace dimension")
+	}
+	ExpectTimeout(t, p)
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"testing"
+)
+
+// TestEnqueueWhileInFlightIsHeldNotRequeued verifies that an Enqueue arriving for a proxy
+// that is already dequeued-but-not-MarkDone is held rather than made immediately dequeuable,
+// so two PushWorkers can never race a push to the same connection.
+func TestEnqueueWhileInFlightIsHeldNotRequeued(t *testing.T) {
+	p := NewPushQueue()
+	con := &XdsConnection{ConID: "proxy-0"}
+
+	p.Enqueue(con, &PushEvent{})
+	ExpectDequeue(t, p, con)
+
+	// con is now in flight (dequeued, not yet MarkDone). A second Enqueue for it must not be
+	// made dequeuable until MarkDone.
+	p.Enqueue(con, &PushEvent{})
+	ExpectTimeout(t, p)
+
+	p.MarkDone(con)
+	ExpectDequeue(t, p, con)
+	ExpectTimeout(t, p)
+}
+
+// TestEnqueueWhileInFlightMergesHeldEvents verifies multiple Enqueues that arrive while a push
+// is in flight are merged together into a single held event, delivered once MarkDone fires.
+func TestEnqueueWhileInFlightMergesHeldEvents(t *testing.T) {
+	p := NewPushQueue()
+	con := &XdsConnection{ConID: "proxy-0"}
+
+	p.Enqueue(con, &PushEvent{})
+	ExpectDequeue(t, p, con)
+
+	p.Enqueue(con, &PushEvent{edsUpdatedServices: map[string]struct{}{"foo": {}}})
+	p.Enqueue(con, &PushEvent{edsUpdatedServices: map[string]struct{}{"bar": {}}})
+
+	p.MarkDone(con)
+
+	_, info := p.Dequeue()
+	if _, ok := info.edsUpdatedServices["foo"]; !ok {
+		t.Fatal("expected held event to include foo")
+	}
+	if _, ok := info.edsUpdatedServices["bar"]; !ok {
+		t.Fatal("expected held event to include bar")
+	}
+	p.MarkDone(con)
+	ExpectTimeout(t, p)
+}
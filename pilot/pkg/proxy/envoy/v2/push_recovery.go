@@ -0,0 +1,112 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"istio.io/pkg/monitoring"
+)
+
+var (
+	pushTypeTag = monitoring.MustCreateLabel("type")
+
+	pushPanics = monitoring.NewSum(
+		"pilot_xds_push_panic_total",
+		"Total number of panics recovered from while processing the XDS push queue.",
+		monitoring.WithLabels(pushTypeTag),
+	)
+
+	// pushQueueWaitSeconds is labelled by push type (full or eds), not by scheduler lane: an
+	// incremental push promoted to the priority lane after starving is still recorded as eds.
+	pushQueueWaitSeconds = monitoring.NewDistribution(
+		"pilot_xds_push_queue_wait_seconds",
+		"Time a push spent in the XDS push queue before being dequeued, by push type.",
+		[]float64{.01, .1, .5, 1, 3, 5, 10, 20, 30, 60},
+		monitoring.WithLabels(pushTypeTag),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(pushPanics)
+	monitoring.MustRegister(pushQueueWaitSeconds)
+}
+
+// PushFunc sends a single PushEvent to a connection. It is supplied by the caller of
+// PushWorker so this package does not need to know how a given proxy's config is built.
+type PushFunc func(con *XdsConnection, ev *PushEvent) error
+
+// DisconnectFunc tears down a single proxy's connection. It is invoked whenever a push to
+// that proxy fails or panics, so the rest of Pilot keeps serving other proxies.
+type DisconnectFunc func(con *XdsConnection)
+
+// PushWorker repeatedly dequeues the next pending PushEvent and hands it to push, recovering
+// from any panic raised while building or sending that proxy's config. A panic disconnects
+// only the offending connection - the worker keeps running and goes on to service the rest
+// of the queue. Callers typically run several of these concurrently, one per push worker
+// goroutine.
+func (p *PushQueue) PushWorker(push PushFunc, disconnect DisconnectFunc) {
+	for {
+		con, ev := p.Dequeue()
+		p.pushOne(con, ev, push, disconnect)
+	}
+}
+
+func (p *PushQueue) pushOne(con *XdsConnection, ev *PushEvent, push PushFunc, disconnect DisconnectFunc) {
+	var disconnected bool
+	guardedDisconnect := func(con *XdsConnection) {
+		disconnected = true
+		disconnect(con)
+	}
+
+	defer func() {
+		if disconnected {
+			// con is gone - don't hand a torn-down proxy's worker another held push.
+			p.Discard(con)
+			return
+		}
+		p.MarkDone(con)
+	}()
+	defer p.recoverPush(con, ev, guardedDisconnect)
+
+	if err := push(con, ev); err != nil {
+		adsLog.Warnf("push to %s failed, disconnecting: %v", con.ConID, err)
+		guardedDisconnect(con)
+	}
+}
+
+func (p *PushQueue) recoverPush(con *XdsConnection, ev *PushEvent, disconnect DisconnectFunc) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	pushPanics.With(pushTypeTag.Value(pushEventType(ev))).Increment()
+	adsLog.Errorf("recovered from panic while pushing to %s: %v", con.ConID, r)
+
+	var err error
+	if p.Recover != nil {
+		err = p.Recover(con, r)
+	}
+	if err != nil {
+		adsLog.Errorf("custom recovery handler for %s failed, disconnecting anyway: %v", con.ConID, err)
+	}
+	disconnect(con)
+}
+
+func pushEventType(ev *PushEvent) string {
+	if ev != nil && ev.full {
+		return "full"
+	}
+	return "eds"
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestPushWorkerRecoversPanic verifies that a panic while pushing to one proxy disconnects
+// only that proxy, and that the worker keeps servicing the remaining queue afterwards.
+func TestPushWorkerRecoversPanic(t *testing.T) {
+	p := NewPushQueue()
+
+	panicky := &XdsConnection{ConID: "panicky"}
+	healthy := make([]*XdsConnection, 0, 5)
+	for i := 0; i < 5; i++ {
+		healthy = append(healthy, &XdsConnection{ConID: fmt.Sprintf("healthy-%d", i)})
+	}
+
+	p.Enqueue(panicky, &PushEvent{})
+	for _, con := range healthy {
+		p.Enqueue(con, &PushEvent{})
+	}
+
+	var mu sync.Mutex
+	disconnected := map[*XdsConnection]bool{}
+	pushed := map[*XdsConnection]bool{}
+
+	disconnect := func(con *XdsConnection) {
+		mu.Lock()
+		defer mu.Unlock()
+		disconnected[con] = true
+	}
+	push := func(con *XdsConnection, ev *PushEvent) error {
+		if con == panicky {
+			panic("boom")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		pushed[con] = true
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < len(healthy)+1; i++ {
+			con, ev := p.Dequeue()
+			p.pushOne(con, ev, push, disconnect)
+		}
+		close(done)
+	}()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !disconnected[panicky] {
+		t.Fatal("expected the panicking connection to be disconnected")
+	}
+	for _, con := range healthy {
+		if !pushed[con] {
+			t.Fatalf("expected %s to still be pushed to after a sibling panicked", con.ConID)
+		}
+		if disconnected[con] {
+			t.Fatalf("did not expect %s to be disconnected", con.ConID)
+		}
+	}
+}
+
+// TestPushWorkerDropsHeldEventOnDisconnect verifies that an event which accumulated in
+// heldEvents while a push was in flight is discarded, not re-enqueued, if that push ends in the
+// connection being disconnected - a torn-down proxy must not be handed another push.
+func TestPushWorkerDropsHeldEventOnDisconnect(t *testing.T) {
+	p := NewPushQueue()
+	con := &XdsConnection{ConID: "proxy-0"}
+
+	p.Enqueue(con, &PushEvent{})
+	dequeued, ev := p.Dequeue()
+
+	// While the push above is in flight, a second update arrives for the same proxy and is
+	// held rather than requeued.
+	p.Enqueue(con, &PushEvent{})
+
+	push := func(*XdsConnection, *PushEvent) error { return fmt.Errorf("push failed") }
+	disconnect := func(*XdsConnection) {}
+
+	p.pushOne(dequeued, ev, push, disconnect)
+
+	ExpectTimeout(t, p)
+	if p.Pending() != 0 {
+		t.Fatalf("expected no pending pushes after disconnect, got %d", p.Pending())
+	}
+}
+
+// TestPushWorkerCustomRecoveryHandler verifies that a custom RecoveryHandler is invoked on
+// panic and that returning nil from it still results in the connection being disconnected.
+func TestPushWorkerCustomRecoveryHandler(t *testing.T) {
+	p := NewPushQueue()
+	con := &XdsConnection{ConID: "proxy-0"}
+
+	var called bool
+	var gotPanic interface{}
+	p.Recover = func(c *XdsConnection, r interface{}) error {
+		called = true
+		gotPanic = r
+		return nil
+	}
+
+	var disconnected bool
+	disconnect := func(*XdsConnection) { disconnected = true }
+	push := func(*XdsConnection, *PushEvent) error { panic("custom handler test") }
+
+	p.pushOne(con, &PushEvent{}, push, disconnect)
+
+	if !called {
+		t.Fatal("expected custom RecoveryHandler to be invoked")
+	}
+	if gotPanic != "custom handler test" {
+		t.Fatalf("expected panic value to be passed through, got %v", gotPanic)
+	}
+	if !disconnected {
+		t.Fatal("expected connection to be disconnected after panic")
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// defaultStarvationThreshold is how long an incremental push can wait in its namespace's normal
+// lane before PushQueue starts treating it as priority work, so a steady stream of full pushes
+// in the same namespace can't starve it indefinitely. Fairness across namespaces comes from
+// the round-robin rotation, not from this threshold.
+const defaultStarvationThreshold = 30 * time.Second
+
+// PushEvent represents a single push request queued for a proxy. Multiple events for the
+// same proxy are merged together while they wait in the queue, so a proxy only ever has one
+// pending event at a time.
+type PushEvent struct {
+	full bool
+
+	// edsUpdatedServices contains the services that have changed. It is only relevant when
+	// full is false - a full push always recomputes everything.
+	edsUpdatedServices map[string]struct{}
+
+	push *model.PushContext
+
+	// start is the time the original push was requested, used for queue wait metrics.
+	start time.Time
+
+	// request scopes the push to the namespaces/services/config kinds it actually affects,
+	// so Enqueue can silently drop proxies that could not possibly care about it. A nil
+	// request (the zero value) is treated as unscoped and is relevant to every proxy.
+	request *PushRequest
+}
+
+// IsFull reports whether this PushEvent is a full push, for callers outside this package that
+// need to tell incremental and full pushes apart without reaching into PushEvent's otherwise-
+// internal fields.
+func (ev *PushEvent) IsFull() bool {
+	return ev != nil && ev.full
+}
+
+// NewEDSPushEvent builds an incremental PushEvent scoped to updatedServices. It exists for
+// callers outside this package - such as cross-cluster endpoint federation - that need to
+// enqueue a push without reaching into PushEvent's otherwise-internal fields.
+func NewEDSPushEvent(updatedServices map[string]struct{}) *PushEvent {
+	return &PushEvent{
+		edsUpdatedServices: updatedServices,
+	}
+}
+
+// Merge two update requests together. Accepts the other PushEvent, and merges it with the
+// current one, returning a new PushEvent. The other event is the most recent of the two, so
+// its push context wins, but the earlier start time is kept so wait-time metrics reflect the
+// full time the proxy has been waiting.
+func (first *PushEvent) Merge(other *PushEvent) *PushEvent {
+	if other == nil {
+		return first
+	}
+	if first == nil {
+		return other
+	}
+
+	merged := &PushEvent{
+		full:    first.full || other.full,
+		push:    other.push,
+		start:   first.start,
+		request: first.request.Merge(other.request),
+	}
+
+	if !merged.full {
+		merged.edsUpdatedServices = make(map[string]struct{})
+		for k := range first.edsUpdatedServices {
+			merged.edsUpdatedServices[k] = struct{}{}
+		}
+		for k := range other.edsUpdatedServices {
+			merged.edsUpdatedServices[k] = struct{}{}
+		}
+	}
+
+	return merged
+}
+
+// RecoveryHandler is invoked when the push loop recovers from a panic while processing a
+// single proxy's PushEvent. It receives the connection that was being pushed to when the
+// panic occurred and the recovered panic value. A returned error is only logged: the
+// connection is disconnected whether or not the handler returns one. Operators can install
+// their own RecoveryHandler on a PushQueue to customize behavior (e.g. alerting) beyond the
+// default logging and disconnection.
+type RecoveryHandler func(con *XdsConnection, r interface{}) error
+
+// namespaceQueue holds the proxies pending in a single ConfigNamespace, split into a priority
+// lane (full pushes, plus incrementals that have aged past the starvation threshold) and a
+// normal lane for everything else. Dequeue always drains the priority lane first.
+type namespaceQueue struct {
+	priority []*XdsConnection
+	normal   []*XdsConnection
+}
+
+func (q *namespaceQueue) empty() bool {
+	return len(q.priority) == 0 && len(q.normal) == 0
+}
+
+func (q *namespaceQueue) push(con *XdsConnection, priority bool) {
+	if priority {
+		q.priority = append(q.priority, con)
+	} else {
+		q.normal = append(q.normal, con)
+	}
+}
+
+// PushQueue is a two-tier scheduler for XDS pushes. Proxies are bucketed by ConfigNamespace
+// and served round-robin across namespaces, so one noisy namespace cannot monopolize the
+// workers; within a namespace, full pushes and starved incrementals jump the line ahead of
+// fresh incremental ones.
+type PushQueue struct {
+	mu   *sync.RWMutex
+	cond *sync.Cond
+
+	// eventsMap maps a proxy to the (possibly merged) event waiting to be pushed to it.
+	eventsMap map[*XdsConnection]*PushEvent
+
+	// namespaces holds each ConfigNamespace's pending proxies.
+	namespaces map[string]*namespaceQueue
+
+	// nsOrder is the round-robin rotation of namespaces that currently have pending work; rr
+	// is the index Dequeue resumes scanning from next.
+	nsOrder map[string]int
+	nsByIdx []string
+	rr      int
+
+	pending int
+
+	// inProgress marks proxies that have been dequeued but not yet marked done. While a proxy
+	// is in inProgress, Enqueue holds any new event for it in heldEvents instead of making it
+	// dequeuable again, so two PushWorkers can never race a push to the same connection.
+	inProgress map[*XdsConnection]struct{}
+
+	// heldEvents accumulates events for proxies currently in inProgress. MarkDone re-enqueues
+	// the held event, if any, once the in-flight push completes.
+	heldEvents map[*XdsConnection]*PushEvent
+
+	// Recover, when set, is invoked by the push loop if handling a dequeued event panics.
+	Recover RecoveryHandler
+
+	// StarvationThreshold is how long an incremental push can wait before it is promoted to
+	// the priority lane. Defaults to defaultStarvationThreshold.
+	StarvationThreshold time.Duration
+}
+
+// NewPushQueue creates a new PushQueue.
+func NewPushQueue() *PushQueue {
+	mu := &sync.RWMutex{}
+	return &PushQueue{
+		mu:                  mu,
+		eventsMap:           make(map[*XdsConnection]*PushEvent),
+		namespaces:          make(map[string]*namespaceQueue),
+		nsOrder:             make(map[string]int),
+		inProgress:          make(map[*XdsConnection]struct{}),
+		heldEvents:          make(map[*XdsConnection]*PushEvent),
+		cond:                sync.NewCond(mu),
+		StarvationThreshold: defaultStarvationThreshold,
+	}
+}
+
+func (p *PushQueue) namespaceOf(proxy *XdsConnection) string {
+	if proxy.modelNode == nil {
+		return ""
+	}
+	return proxy.modelNode.ConfigNamespace
+}
+
+func (p *PushQueue) namespaceQueueFor(ns string) *namespaceQueue {
+	q, ok := p.namespaces[ns]
+	if !ok {
+		q = &namespaceQueue{}
+		p.namespaces[ns] = q
+	}
+	return q
+}
+
+// activateNamespace adds ns to the round-robin rotation if it isn't already in it.
+func (p *PushQueue) activateNamespace(ns string) {
+	if _, ok := p.nsOrder[ns]; ok {
+		return
+	}
+	p.nsOrder[ns] = len(p.nsByIdx)
+	p.nsByIdx = append(p.nsByIdx, ns)
+}
+
+// deactivateNamespace removes ns from the round-robin rotation once it has no pending work, so
+// Dequeue only ever scans namespaces that currently have something queued rather than every
+// namespace ever seen. It is a swap-remove, so it reindexes whichever namespace previously
+// occupied the last slot.
+func (p *PushQueue) deactivateNamespace(ns string) {
+	idx, ok := p.nsOrder[ns]
+	if !ok {
+		return
+	}
+	last := len(p.nsByIdx) - 1
+	movedNs := p.nsByIdx[last]
+	p.nsByIdx[idx] = movedNs
+	p.nsOrder[movedNs] = idx
+	p.nsByIdx = p.nsByIdx[:last]
+	delete(p.nsOrder, ns)
+}
+
+// promoteToPriority moves proxy from its namespace's normal lane into the priority lane, used
+// when a merge upgrades an already-queued incremental push into a full one.
+func (p *PushQueue) promoteToPriority(proxy *XdsConnection) {
+	q := p.namespaceQueueFor(p.namespaceOf(proxy))
+	for i, con := range q.normal {
+		if con == proxy {
+			q.normal = append(q.normal[:i], q.normal[i+1:]...)
+			q.priority = append(q.priority, proxy)
+			return
+		}
+	}
+}
+
+// Enqueue will mark a proxy as pending a push. If it is already pending, pushEv will be
+// merged with the existing event. If the proxy currently has a push in flight (it has been
+// Dequeued but not yet MarkDone), pushEv is instead merged into a held event that MarkDone
+// will enqueue once that push completes, rather than being made dequeuable immediately.
+// Enqueue wakes a single blocked Dequeue call, if any.
+func (p *PushQueue) Enqueue(proxy *XdsConnection, pushEv *PushEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pushEv.start.IsZero() {
+		pushEv.start = time.Now()
+	}
+
+	if !pushEv.request.relevantTo(proxy) {
+		return
+	}
+
+	if _, busy := p.inProgress[proxy]; busy {
+		p.heldEvents[proxy] = p.heldEvents[proxy].Merge(pushEv)
+		return
+	}
+
+	p.enqueueLocked(proxy, pushEv)
+}
+
+// enqueueLocked inserts pushEv into proxy's namespace queue, merging with any event already
+// waiting there. Callers must hold p.mu and must already have confirmed proxy has no push
+// currently in flight.
+func (p *PushQueue) enqueueLocked(proxy *XdsConnection, pushEv *PushEvent) {
+	if event, exists := p.eventsMap[proxy]; exists {
+		merged := event.Merge(pushEv)
+		p.eventsMap[proxy] = merged
+		if merged.full && !event.full {
+			p.promoteToPriority(proxy)
+		}
+		return
+	}
+
+	p.eventsMap[proxy] = pushEv
+	ns := p.namespaceOf(proxy)
+	p.namespaceQueueFor(ns).push(proxy, pushEv.full)
+	p.activateNamespace(ns)
+	p.pending++
+	p.cond.Signal()
+}
+
+// Dequeue removes the next item according to the priority + fairness schedule and returns it
+// along with its merged PushEvent. Dequeue blocks until an item is available.
+func (p *PushQueue) Dequeue() (*XdsConnection, *PushEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.pending == 0 {
+		p.cond.Wait()
+	}
+
+	con, _ := p.pickNext()
+	info := p.eventsMap[con]
+	delete(p.eventsMap, con)
+	p.pending--
+	p.inProgress[con] = struct{}{}
+
+	pushQueueWaitSeconds.With(pushTypeTag.Value(pushEventType(info))).Record(time.Since(info.start).Seconds())
+
+	return con, info
+}
+
+// pickNext scans namespaces in round-robin order starting after the last one served, and
+// returns the first pending proxy it finds, preferring a namespace's priority lane. It also
+// promotes normal-lane heads that have aged past StarvationThreshold into the priority lane
+// of their namespace before picking, so a proxy can't wait indefinitely behind later full
+// pushes in its own namespace.
+func (p *PushQueue) pickNext() (*XdsConnection, string) {
+	threshold := p.StarvationThreshold
+	if threshold <= 0 {
+		threshold = defaultStarvationThreshold
+	}
+
+	n := len(p.nsByIdx)
+	for i := 0; i < n; i++ {
+		idx := (p.rr + i) % n
+		ns := p.nsByIdx[idx]
+		q := p.namespaces[ns]
+		if q.empty() {
+			continue
+		}
+
+		if len(q.normal) > 0 {
+			head := q.normal[0]
+			if ev := p.eventsMap[head]; ev != nil && time.Since(ev.start) >= threshold {
+				q.normal = q.normal[1:]
+				q.priority = append(q.priority, head)
+			}
+		}
+
+		var con *XdsConnection
+		if len(q.priority) > 0 {
+			con = q.priority[0]
+			q.priority = q.priority[1:]
+		} else {
+			con = q.normal[0]
+			q.normal = q.normal[1:]
+		}
+
+		if q.empty() {
+			// deactivateNamespace swap-removes ns, moving the last rotation slot into idx -
+			// resume scanning from idx next time so that moved namespace isn't skipped.
+			p.deactivateNamespace(ns)
+			if len(p.nsByIdx) > 0 {
+				p.rr = idx % len(p.nsByIdx)
+			} else {
+				p.rr = 0
+			}
+		} else {
+			p.rr = (idx + 1) % n
+		}
+		return con, ns
+	}
+
+	// Unreachable: p.pending > 0 guarantees some namespace is non-empty.
+	return nil, ""
+}
+
+// MarkDone marks a proxy push as done. If an event accumulated in heldEvents while the push
+// was in flight, it is enqueued now, making the proxy dequeuable again.
+func (p *PushQueue) MarkDone(proxy *XdsConnection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inProgress, proxy)
+
+	held, ok := p.heldEvents[proxy]
+	if !ok {
+		return
+	}
+	delete(p.heldEvents, proxy)
+	p.enqueueLocked(proxy, held)
+}
+
+// Discard marks a proxy push as done without re-enqueuing any event that accumulated in
+// heldEvents while it was in flight. Use this instead of MarkDone when the push failed or
+// panicked and the connection was torn down, so a disconnected proxy isn't handed another push.
+func (p *PushQueue) Discard(proxy *XdsConnection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inProgress, proxy)
+	delete(p.heldEvents, proxy)
+}
+
+// Pending returns the number of proxies with a push currently queued.
+func (p *PushQueue) Pending() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pending
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestFullPushOvertakesQueuedIncrementals verifies that once an already-queued incremental
+// push is merged into a full push, it jumps ahead of an older incremental queued before it in
+// the same namespace - the priority lane, not round-robin across namespaces, is what's under
+// test here, so both proxies must share a namespace.
+func TestFullPushOvertakesQueuedIncrementals(t *testing.T) {
+	p := NewPushQueue()
+
+	a := proxyInNamespace("a", "ns-shared")
+	b := proxyInNamespace("b", "ns-shared")
+
+	// b is queued first as an incremental...
+	p.Enqueue(b, &PushEvent{})
+	// ...then a is queued as an incremental too...
+	p.Enqueue(a, &PushEvent{})
+	// ...but a's pending push is upgraded to full, so it should jump ahead of b despite being
+	// queued second.
+	p.Enqueue(a, &PushEvent{full: true})
+
+	ExpectDequeue(t, p, a)
+	ExpectDequeue(t, p, b)
+}
+
+// TestRoundRobinAcrossNamespaces verifies that 1000 enqueues split across 10 namespaces
+// dequeue in round-robin, interleaved order rather than draining one namespace at a time.
+func TestRoundRobinAcrossNamespaces(t *testing.T) {
+	p := NewPushQueue()
+	const perNamespace = 100
+	const namespaces = 10
+
+	var proxies []*XdsConnection
+	for ns := 0; ns < namespaces; ns++ {
+		for i := 0; i < perNamespace; i++ {
+			con := proxyInNamespace(fmt.Sprintf("ns%d-p%d", ns, i), fmt.Sprintf("ns%d", ns))
+			proxies = append(proxies, con)
+			p.Enqueue(con, &PushEvent{})
+		}
+	}
+
+	// Track, for each namespace, how many dequeues have happened so far. In round-robin
+	// order the max gap between any two namespaces' counters should stay small throughout -
+	// a batched (non-interleaved) drain would let one namespace's counter run far ahead of
+	// the others before they are touched at all.
+	seen := make(map[string]int)
+	for i := 0; i < namespaces*perNamespace; i++ {
+		con, _ := p.Dequeue()
+		seen[p.namespaceOf(con)]++
+
+		if i >= namespaces {
+			min, max := -1, -1
+			for ns := 0; ns < namespaces; ns++ {
+				c := seen[fmt.Sprintf("ns%d", ns)]
+				if min == -1 || c < min {
+					min = c
+				}
+				if max == -1 || c > max {
+					max = c
+				}
+			}
+			if max-min > 1 {
+				t.Fatalf("expected round-robin interleaving, but namespace dequeue counts diverged: min=%d max=%d after %d dequeues", min, max, i+1)
+			}
+		}
+	}
+
+	for ns := 0; ns < namespaces; ns++ {
+		if seen[fmt.Sprintf("ns%d", ns)] != perNamespace {
+			t.Fatalf("expected %d dequeues for ns%d, got %d", perNamespace, ns, seen[fmt.Sprintf("ns%d", ns)])
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package peering lets one Pilot subscribe to another Pilot's endpoint and service updates
+// over a bidirectional streaming link, so a multi-cluster mesh doesn't require every sidecar
+// to establish XDS sessions with every control plane. Each received delta is re-injected into
+// the local PushQueue as a scoped EDS-only PushEvent targeting only the proxies whose
+// SidecarScope actually imports the remote service.
+package peering
+
+// DeltaOp describes the kind of change a single EndpointDelta carries.
+type DeltaOp int
+
+const (
+	// Add announces a new endpoint.
+	Add DeltaOp = iota
+	// Update announces a change to an existing endpoint (health, labels, etc).
+	Update
+	// Remove announces an endpoint has gone away.
+	Remove
+)
+
+func (op DeltaOp) String() string {
+	switch op {
+	case Add:
+		return "add"
+	case Update:
+		return "update"
+	case Remove:
+		return "remove"
+	default:
+		return "unknown"
+	}
+}
+
+// Endpoint is the peer-local view of a single service endpoint. It intentionally carries only
+// the fields a remote Pilot needs to reconstruct an EDS update, rather than a full
+// model.IstioEndpoint, so the wire format doesn't change every time the local endpoint model
+// grows a field.
+type Endpoint struct {
+	Address string
+	Port    uint32
+	Network string
+	Labels  map[string]string
+}
+
+// EndpointDelta is a single incremental change to one service's endpoint set.
+type EndpointDelta struct {
+	Op       DeltaOp
+	Service  string
+	Endpoint Endpoint
+}
+
+// Delta is one message on the peer stream: a batch of endpoint changes plus the resume token
+// a reconnecting peer should present to pick back up after this message.
+type Delta struct {
+	ResumeToken string
+	Endpoints   []EndpointDelta
+}
+
+// servicesOf returns the distinct set of services touched by a Delta, used to scope the
+// PushEvent synthesized for it.
+func (d *Delta) servicesOf() map[string]struct{} {
+	services := make(map[string]struct{}, len(d.Endpoints))
+	for _, e := range d.Endpoints {
+		services[e.Service] = struct{}{}
+	}
+	return services
+}
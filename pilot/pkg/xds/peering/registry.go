@@ -0,0 +1,188 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peering
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	v2 "istio.io/istio/pilot/pkg/proxy/envoy/v2"
+	"istio.io/pkg/log"
+)
+
+var peeringLog = log.RegisterScope("peering", "cross-pilot EDS federation", 0)
+
+// defaultQueueHighWaterMark bounds how far a peer's delta stream is allowed to run ahead of
+// the local push workers. Once the shared PushQueue has this many pushes pending, PeerRegistry
+// pauses reading further deltas from every peer until the workers dequeue it back below the
+// mark, rather than keeping a separate credit system that could drift out of sync with the
+// queue the workers actually use. Pushes that are dequeued but not yet MarkDone do not count
+// toward the mark.
+const defaultQueueHighWaterMark = 4096
+
+const queuePollInterval = 10 * time.Millisecond
+
+// PushTarget resolves which local proxies care about a set of remote services, so an incoming
+// delta can be turned into a scoped push instead of waking up every proxy on the cluster.
+type PushTarget interface {
+	// ProxiesInterestedIn returns the proxies whose SidecarScope imports at least one of
+	// services.
+	ProxiesInterestedIn(services map[string]struct{}) []*v2.XdsConnection
+}
+
+// Peer is the registry's bookkeeping for one subscribed remote Pilot.
+type Peer struct {
+	Name string
+
+	mu          sync.Mutex
+	resumeToken string
+}
+
+// ResumeToken returns the token to present when re-subscribing to this peer after a
+// disconnect, so the remote side can resume the delta stream instead of resending a full
+// snapshot.
+func (p *Peer) ResumeToken() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumeToken
+}
+
+func (p *Peer) setResumeToken(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resumeToken = token
+}
+
+// PeerRegistry tracks the set of remote Pilots this one is federated with and re-injects their
+// endpoint/service deltas into the local PushQueue.
+type PeerRegistry struct {
+	queue   *v2.PushQueue
+	targets PushTarget
+
+	// HighWaterMark overrides defaultQueueHighWaterMark; exposed for tests.
+	HighWaterMark int
+
+	mu    sync.RWMutex
+	peers map[string]*Peer
+}
+
+// NewPeerRegistry creates a PeerRegistry that injects scoped EDS PushEvents into queue for
+// proxies resolved via targets.
+func NewPeerRegistry(queue *v2.PushQueue, targets PushTarget) *PeerRegistry {
+	return &PeerRegistry{
+		queue:         queue,
+		targets:       targets,
+		HighWaterMark: defaultQueueHighWaterMark,
+		peers:         make(map[string]*Peer),
+	}
+}
+
+// Peer returns the bookkeeping for a previously or currently subscribed peer, if any.
+func (r *PeerRegistry) Peer(name string) (*Peer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.peers[name]
+	return p, ok
+}
+
+// Subscribe authenticates stream as name and then blocks, reading deltas off it and
+// re-injecting them into the local PushQueue, until stream.Recv returns an error (including
+// context cancellation). It returns that error to the caller, who is expected to redial using
+// Peer(name).ResumeToken() to pick the stream back up where it left off.
+func (r *PeerRegistry) Subscribe(ctx context.Context, name string, stream Stream, auth Authenticator) error {
+	if auth == nil {
+		auth = AllowAny{}
+	}
+	spiffeID, err := auth.Authenticate(ctx)
+	if err != nil {
+		return fmt.Errorf("peering: rejecting peer %q: %w", name, err)
+	}
+	peeringLog.Infof("peer %q authenticated as %q, subscribing to endpoint deltas", name, spiffeID)
+
+	r.mu.Lock()
+	peer, resubscribed := r.peers[name]
+	if !resubscribed {
+		peer = &Peer{Name: name}
+		r.peers[name] = peer
+	}
+	r.mu.Unlock()
+
+	if token := peer.ResumeToken(); token != "" {
+		// Tell the remote where we left off, so it can replay only what changed since then
+		// instead of resending a full snapshot. This carries no endpoints, so handleDelta
+		// on the far side will record it as the new high-water mark without enqueuing a push.
+		if err := stream.Send(&Delta{ResumeToken: token}); err != nil {
+			return fmt.Errorf("peering: failed to send resume token to peer %q: %w", name, err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		r.waitForCapacity(ctx)
+
+		delta, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		r.handleDelta(peer, delta)
+	}
+}
+
+// waitForCapacity blocks while the shared PushQueue is backed up, so a fast remote peer can't
+// flood local proxies faster than the local push workers dequeue pending pushes.
+func (r *PeerRegistry) waitForCapacity(ctx context.Context) {
+	high := r.HighWaterMark
+	if high <= 0 {
+		high = defaultQueueHighWaterMark
+	}
+	for r.queue.Pending() >= high {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(queuePollInterval):
+		}
+	}
+}
+
+// handleDelta resolves the interested local proxies for delta and enqueues one scoped,
+// incremental PushEvent per proxy.
+func (r *PeerRegistry) handleDelta(peer *Peer, delta *Delta) {
+	defer peer.setResumeToken(delta.ResumeToken)
+
+	services := delta.servicesOf()
+	if len(services) == 0 {
+		return
+	}
+
+	targets := r.targets.ProxiesInterestedIn(services)
+	if len(targets) == 0 {
+		peeringLog.Debugf("peer %q: no local proxy imports %v, dropping delta", peer.Name, services)
+		return
+	}
+
+	for _, con := range targets {
+		// Each proxy gets its own PushEvent. The services set is read-only and safe to
+		// share, but the event itself gets merged with whatever else is already queued or
+		// in flight for that proxy, so proxies must not share one pointer.
+		r.queue.Enqueue(con, v2.NewEDSPushEvent(services))
+	}
+}
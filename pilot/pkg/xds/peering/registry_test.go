@@ -0,0 +1,237 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peering
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	v2 "istio.io/istio/pilot/pkg/proxy/envoy/v2"
+)
+
+// chanStream is an in-memory Stream used to connect two in-process PeerRegistrys in tests,
+// standing in for the bidirectional gRPC stream used in production.
+type chanStream struct {
+	out    chan *Delta
+	in     chan *Delta
+	closed chan struct{}
+}
+
+func newChanStreamPair() (a, b *chanStream) {
+	ab := make(chan *Delta, 16)
+	ba := make(chan *Delta, 16)
+	closed := make(chan struct{})
+	return &chanStream{out: ab, in: ba, closed: closed}, &chanStream{out: ba, in: ab, closed: closed}
+}
+
+func (s *chanStream) Send(d *Delta) error {
+	select {
+	case s.out <- d:
+		return nil
+	case <-s.closed:
+		return errors.New("stream closed")
+	}
+}
+
+func (s *chanStream) Recv() (*Delta, error) {
+	select {
+	case d := <-s.in:
+		return d, nil
+	case <-s.closed:
+		return nil, errors.New("stream closed")
+	}
+}
+
+func (s *chanStream) CloseSend() error {
+	close(s.closed)
+	return nil
+}
+
+// fakeTargets resolves a fixed map of service -> interested proxies, standing in for the real
+// SidecarScope-based lookup.
+type fakeTargets struct {
+	interested map[string][]*v2.XdsConnection
+}
+
+func (f *fakeTargets) ProxiesInterestedIn(services map[string]struct{}) []*v2.XdsConnection {
+	seen := map[*v2.XdsConnection]struct{}{}
+	var out []*v2.XdsConnection
+	for svc := range services {
+		for _, con := range f.interested[svc] {
+			if _, ok := seen[con]; ok {
+				continue
+			}
+			seen[con] = struct{}{}
+			out = append(out, con)
+		}
+	}
+	return out
+}
+
+func TestPeerRegistryInjectsScopedEDSPush(t *testing.T) {
+	clientSide, serverSide := newChanStreamPair()
+
+	proxyA := &v2.XdsConnection{ConID: "cluster-b-proxy-a"}
+	proxyB := &v2.XdsConnection{ConID: "cluster-b-proxy-b"}
+	targets := &fakeTargets{interested: map[string][]*v2.XdsConnection{
+		"reviews.default.svc.cluster.local": {proxyA, proxyB},
+	}}
+
+	localQueue := v2.NewPushQueue()
+	registry := NewPeerRegistry(localQueue, targets)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- registry.Subscribe(ctx, "cluster-a", serverSide, AllowAny{})
+	}()
+
+	if err := clientSide.Send(&Delta{
+		ResumeToken: "token-1",
+		Endpoints: []EndpointDelta{
+			{Op: Add, Service: "reviews.default.svc.cluster.local", Endpoint: Endpoint{Address: "10.0.0.5", Port: 9080}},
+		},
+	}); err != nil {
+		t.Fatalf("failed to send delta: %v", err)
+	}
+
+	gotA, gotB := false, false
+	for i := 0; i < 2; i++ {
+		con, ev := localQueue.Dequeue()
+		if ev.IsFull() {
+			t.Fatal("expected an incremental EDS push, got a full push")
+		}
+		switch con {
+		case proxyA:
+			gotA = true
+		case proxyB:
+			gotB = true
+		default:
+			t.Fatalf("unexpected proxy pushed: %v", con)
+		}
+		localQueue.MarkDone(con)
+	}
+	if !gotA || !gotB {
+		t.Fatalf("expected exactly one push each for proxyA and proxyB, gotA=%v gotB=%v", gotA, gotB)
+	}
+	if pending := localQueue.Pending(); pending != 0 {
+		t.Fatalf("expected no extra pushes to be queued, found %d pending", pending)
+	}
+
+	if err := clientSide.CloseSend(); err != nil {
+		t.Fatalf("failed to close stream: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Subscribe to return after stream close")
+	}
+
+	peer, ok := registry.Peer("cluster-a")
+	if !ok {
+		t.Fatal("expected peer bookkeeping to be recorded")
+	}
+	if peer.ResumeToken() != "token-1" {
+		t.Fatalf("expected resume token %q, got %q", "token-1", peer.ResumeToken())
+	}
+}
+
+func TestPeerRegistryResubscribePreservesAndSendsResumeToken(t *testing.T) {
+	clientSide, serverSide := newChanStreamPair()
+	localQueue := v2.NewPushQueue()
+	registry := NewPeerRegistry(localQueue, &fakeTargets{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- registry.Subscribe(ctx, "cluster-a", serverSide, AllowAny{})
+	}()
+
+	if err := clientSide.Send(&Delta{ResumeToken: "token-1"}); err != nil {
+		t.Fatalf("failed to send delta: %v", err)
+	}
+
+	deadline := time.After(time.Second)
+	for {
+		if peer, ok := registry.Peer("cluster-a"); ok && peer.ResumeToken() == "token-1" {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("timed out waiting for resume token to be recorded")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	if err := clientSide.CloseSend(); err != nil {
+		t.Fatalf("failed to close stream: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for first Subscribe to return after stream close")
+	}
+
+	// Re-subscribe the same peer on a fresh stream pair. It should send the previously
+	// recorded resume token to the remote before reading anything back.
+	clientSide2, serverSide2 := newChanStreamPair()
+	done2 := make(chan error, 1)
+	go func() {
+		done2 <- registry.Subscribe(ctx, "cluster-a", serverSide2, AllowAny{})
+	}()
+
+	resumeDelta, err := clientSide2.Recv()
+	if err != nil {
+		t.Fatalf("failed to receive resume delta: %v", err)
+	}
+	if resumeDelta.ResumeToken != "token-1" {
+		t.Fatalf("expected resume token %q to be sent on resubscribe, got %q", "token-1", resumeDelta.ResumeToken)
+	}
+
+	if err := clientSide2.CloseSend(); err != nil {
+		t.Fatalf("failed to close stream: %v", err)
+	}
+	select {
+	case <-done2:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for second Subscribe to return after stream close")
+	}
+}
+
+func TestPeerRegistryRejectsFailedAuth(t *testing.T) {
+	_, serverSide := newChanStreamPair()
+	localQueue := v2.NewPushQueue()
+	registry := NewPeerRegistry(localQueue, &fakeTargets{})
+
+	err := registry.Subscribe(context.Background(), "untrusted", serverSide, failingAuth{})
+	if err == nil {
+		t.Fatal("expected Subscribe to reject an unauthenticated peer")
+	}
+	if _, ok := registry.Peer("untrusted"); ok {
+		t.Fatal("did not expect peer bookkeeping for a rejected peer")
+	}
+}
+
+type failingAuth struct{}
+
+func (failingAuth) Authenticate(context.Context) (string, error) {
+	return "", errors.New("no valid SPIFFE identity presented")
+}
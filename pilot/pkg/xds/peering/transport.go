@@ -0,0 +1,45 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peering
+
+import "context"
+
+// Stream is the peer-to-peer link a PeerRegistry reads Deltas from. In production this is
+// backed by a bidirectional gRPC stream; tests (and in-process multi-cluster setups) can
+// satisfy it with a pair of channels instead.
+type Stream interface {
+	Send(*Delta) error
+	Recv() (*Delta, error)
+	// CloseSend signals the peer there are no more messages coming from this side.
+	CloseSend() error
+}
+
+// Authenticator validates an incoming peer connection and returns its SPIFFE identity.
+// PeerRegistry rejects the subscription if Authenticate returns an error, so operators can
+// plug in whatever mTLS/SPIFFE trust policy their cluster federation requires without
+// PeerRegistry needing to know about certificate chains itself.
+type Authenticator interface {
+	Authenticate(ctx context.Context) (spiffeID string, err error)
+}
+
+// AllowAny is an Authenticator that accepts every peer. It exists for tests and for
+// deployments that terminate mTLS outside of Pilot; production cross-cluster federation
+// should supply a real SPIFFE-checking Authenticator.
+type AllowAny struct{}
+
+// Authenticate implements Authenticator.
+func (AllowAny) Authenticate(context.Context) (string, error) {
+	return "", nil
+}